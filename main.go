@@ -1,15 +1,25 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
+	"math"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
 	"runtime"
+	"strconv"
 	"strings"
-	"time"
+	"sync"
 
 	"github.com/MrSplidge/go-coutil"
 )
@@ -25,6 +35,20 @@ type Track struct {
 	Date      *string
 	Cover     *string
 	Copyright *string
+	// Lyrics is an optional path to a ".lrc" or ".txt" sidecar, embedded into the encoded track
+	// (or written alongside it, for WAV).
+	Lyrics *string
+	// Covers lists additional art (back cover, artist photo, disc art) beyond the single front
+	// cover carried by Cover/Album.Cover.
+	Covers []CoverSpec
+}
+
+// CoverSpec describes one piece of embedded artwork beyond the single front cover that
+// Track.Cover/Album.Cover already carry.
+type CoverSpec struct {
+	Path        string `json:"path"`
+	Role        string `json:"role"` // "front", "back", "artist", or "disc"
+	Description string `json:"description"`
 }
 
 // Mapping from Json to Go.
@@ -41,19 +65,991 @@ type Album struct {
 
 // Mapping from Json to Go.
 type Metadata struct {
-	FfmpegPath       string   `json:"ffmpeg_path"`
+	// FfmpegPath is optional. When empty, go-meta searches $PATH and the directory the go-meta
+	// binary lives in for an "ffmpeg" executable.
+	FfmpegPath string `json:"ffmpeg_path"`
+	// FfprobePath is optional. When empty, go-meta searches $PATH and the directory the go-meta
+	// binary lives in for an "ffprobe" executable. Without ffprobe, skip detection relies on the
+	// manifest alone.
+	FfprobePath      string   `json:"ffprobe_path"`
 	InputPath        string   `json:"input_path"`
 	OutputPath       string   `json:"output_path"`
 	OutputExtensions []string `json:"output_extensions"`
-	Parallel         bool
-	Albums           []Album
+	// Encoders optionally overrides the ffmpeg default for a given OutputExtensions entry, e.g.
+	// to use the flac CLI for lossless masters or MP4Box to mux Dolby Atmos tracks. Extensions
+	// not present here are encoded with ffmpeg.
+	Encoders map[string]EncoderConfig `json:"encoders"`
+	// Loudness optionally enables a two-pass loudness analysis/normalization stage. When set,
+	// every track encoded with ffmpeg (other than "wav", which is a raw stream copy) is measured
+	// before it's encoded, and the measured values are fed into the actual encode. Extensions
+	// with an Encoders override are encoded without loudness analysis.
+	Loudness *LoudnessConfig `json:"loudness"`
+	Parallel bool
+	Albums   []Album
+}
+
+// LoudnessConfig turns on two-pass loudness analysis for every track go-meta encodes with ffmpeg; Mode decides
+// what's done with the measurement.
+type LoudnessConfig struct {
+	// Mode is "ebu-r128" (the default when empty) or "replaygain". "ebu-r128" bakes the pass-1
+	// measurement into a loudnorm filter on the pass-2 encode, permanently altering the audio.
+	// "replaygain" leaves the audio untouched and instead tags each track with
+	// replaygain_track_gain/replaygain_track_peak (alongside the existing album gain tags) for a
+	// player to apply the gain at playback time.
+	Mode       string  `json:"mode"`
+	TargetLufs float64 `json:"target_lufs"`
+}
+
+// loudnessTargetLUFS returns config's configured target loudness, or ffmpeg's loudnorm default of
+// -14 LUFS if it wasn't set (or config is nil).
+func loudnessTargetLUFS(config *LoudnessConfig) float64 {
+	if config != nil && config.TargetLufs != 0 {
+		return config.TargetLufs
+	}
+	return -14.0
+}
+
+// EncoderConfig names an alternative encoder backend for one OutputExtensions entry.
+type EncoderConfig struct {
+	Kind    string   `json:"kind"`    // "flac", "qaac", or "mp4box"
+	Command string   `json:"command"` // path to the external tool; auto-resolved like ffmpeg if empty
+	Args    []string `json:"args"`    // extra tool-specific arguments, e.g. flac's ["-8", "-V"]
+
+	// InputExtension overrides what file processAlbum feeds this encoder, read from
+	// Metadata.InputPath as "<track.RenderedFile>.<InputExtension>" instead of the default
+	// rendered ".wav". "mp4box" needs this to mux an already-encoded elementary stream (e.g. a
+	// Dolby Atmos ".ec3") rather than a raw WAV.
+	InputExtension string `json:"input_extension"`
+}
+
+// ffmpegCapabilities captures the pieces of "ffmpeg -version" / "ffmpeg -codecs" output that
+// go-meta cares about, probed once per run.
+type ffmpegCapabilities struct {
+	Version string
+	Codecs  map[string]bool // encoder name -> enabled in this ffmpeg build
+}
+
+// extensionCodecs maps an OutputExtensions entry to the ffmpeg encoder it relies on.
+var extensionCodecs = map[string]string{
+	"mp3":  "libmp3lame",
+	"flac": "flac",
+	"ogg":  "libvorbis",
+	"wav":  "pcm_s16le",
+}
+
+var (
+	ffmpegProbeOnce   sync.Once
+	ffmpegProbeResult ffmpegCapabilities
+	ffmpegProbeErr    error
+)
+
+// resolveFfmpegPath returns the configured ffmpeg path, or - if configured is empty - the first
+// "ffmpeg" found on $PATH, falling back to an "ffmpeg" binary alongside the running go-meta
+// executable (mirroring how Navidrome resolves its ffmpeg dependency at runtime).
+func resolveFfmpegPath(configured string) (string, error) {
+	return resolveToolPath("ffmpeg", configured)
+}
+
+// resolveFfprobePath returns the configured ffprobe path, or - if configured is empty - the
+// first "ffprobe" found by resolveToolPath. Unlike ffmpeg, ffprobe is optional: callers fall back
+// to the manifest alone for skip detection when it can't be found.
+func resolveFfprobePath(configured string) (string, error) {
+	return resolveToolPath("ffprobe", configured)
+}
+
+// resolveToolPath returns the configured path for a companion ffmpeg tool, or - if configured is
+// empty - the first match on $PATH, falling back to a binary of the same name alongside the
+// running go-meta executable (mirroring how Navidrome resolves its ffmpeg dependencies at
+// runtime).
+func resolveToolPath(name string, configured string) (string, error) {
+	if configured != "" {
+		return filepath.FromSlash(configured), nil
+	}
+
+	if found, err := exec.LookPath(name); err == nil {
+		return found, nil
+	}
+
+	if exe, err := os.Executable(); err == nil {
+		exeName := name
+		if runtime.GOOS == "windows" {
+			exeName += ".exe"
+		}
+		candidate := filepath.Join(filepath.Dir(exe), exeName)
+		if stat, err := os.Stat(candidate); err == nil && !stat.IsDir() {
+			return candidate, nil
+		}
+	}
+
+	return "", fmt.Errorf("could not find %s on $PATH or alongside the go-meta binary; set \"%s_path\" explicitly", name, name)
+}
+
+// probeFfmpeg runs "ffmpeg -version" and "ffmpeg -codecs" once and caches the result, so that
+// parallel workers sharing the same ffmpegPath don't each re-invoke ffmpeg to find out what it
+// supports.
+func probeFfmpeg(ffmpegPath string) (ffmpegCapabilities, error) {
+	ffmpegProbeOnce.Do(func() {
+		ffmpegProbeResult, ffmpegProbeErr = runFfmpegProbe(ffmpegPath)
+	})
+	return ffmpegProbeResult, ffmpegProbeErr
+}
+
+// runFfmpegProbe does the actual probing work for probeFfmpeg.
+func runFfmpegProbe(ffmpegPath string) (ffmpegCapabilities, error) {
+	var caps ffmpegCapabilities
+	caps.Codecs = make(map[string]bool, len(extensionCodecs))
+
+	versionOut, err := exec.Command(ffmpegPath, "-version").Output()
+	if err != nil {
+		return caps, fmt.Errorf("running %s -version: %w", ffmpegPath, err)
+	}
+	versionLine := strings.SplitN(string(versionOut), "\n", 2)[0]
+	caps.Version = strings.TrimSpace(strings.TrimPrefix(versionLine, "ffmpeg version"))
+
+	codecsOut, err := exec.Command(ffmpegPath, "-codecs").Output()
+	if err != nil {
+		return caps, fmt.Errorf("running %s -codecs: %w", ffmpegPath, err)
+	}
+	enabledEncoders := parseFfmpegEncoders(string(codecsOut))
+	for _, name := range []string{"libmp3lame", "flac", "libvorbis", "pcm_s16le"} {
+		caps.Codecs[name] = enabledEncoders[name]
+	}
+
+	return caps, nil
+}
+
+// ffmpegEncodersPattern matches the "(encoders: a b c)" parenthetical that "ffmpeg -codecs"
+// appends to a codec's line for every encoder capable of producing it. A codec's own name always
+// appears earlier on the line regardless of whether an encoder for it exists, so that part of the
+// line can't be used to decide support - only this list can.
+var ffmpegEncodersPattern = regexp.MustCompile(`\(encoders:([^)]*)\)`)
+
+// parseFfmpegEncoders extracts every encoder name ffmpeg advertises across all "(encoders: ...)"
+// parentheticals in the output of "ffmpeg -codecs".
+func parseFfmpegEncoders(codecsText string) map[string]bool {
+	enabled := make(map[string]bool)
+	for _, match := range ffmpegEncodersPattern.FindAllStringSubmatch(codecsText, -1) {
+		for _, name := range strings.Fields(match[1]) {
+			enabled[name] = true
+		}
+	}
+	return enabled
+}
+
+// validateCodecSupport checks that the probed ffmpeg build can actually produce every extension
+// in extensions, returning a single error describing everything that's missing. Extensions with a
+// registered Encoders override never touch ffmpeg, so they're skipped regardless of what caps says.
+func validateCodecSupport(caps ffmpegCapabilities, extensions []string, encoders map[string]EncoderConfig) error {
+	var missing []string
+	for _, extension := range extensions {
+		if _, overridden := encoders[extension]; overridden {
+			continue
+		}
+		codec, ok := extensionCodecs[extension]
+		if !ok {
+			continue
+		}
+		if !caps.Codecs[codec] {
+			missing = append(missing, fmt.Sprintf("%s (needs %s)", extension, codec))
+		}
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("ffmpeg is missing codec support for: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// ffprobeOutput is the subset of "ffprobe -show_format -show_streams -print_format json" that
+// go-meta inspects to decide whether an existing target file is already up to date.
+type ffprobeOutput struct {
+	Format struct {
+		Tags map[string]string `json:"tags"`
+	} `json:"format"`
+	Streams []struct {
+		CodecType string `json:"codec_type"`
+		CodecName string `json:"codec_name"`
+		BitRate   string `json:"bit_rate"`
+	} `json:"streams"`
+}
+
+// probeExistingTarget runs ffprobe against an already-encoded target file and returns its tags
+// and stream info.
+func probeExistingTarget(ffprobePath string, targetPath string) (*ffprobeOutput, error) {
+	out, err := exec.Command(ffprobePath,
+		"-v", "error",
+		"-show_format", "-show_streams",
+		"-print_format", "json",
+		targetPath,
+	).Output()
+	if err != nil {
+		return nil, err
+	}
+
+	var probe ffprobeOutput
+	if err := json.Unmarshal(out, &probe); err != nil {
+		return nil, fmt.Errorf("parsing ffprobe output for %s: %w", targetPath, err)
+	}
+	return &probe, nil
+}
+
+// comparedTagKeys are the metadata fields go-meta verifies against an existing target file.
+// album_artist is deliberately excluded: it's always a copy of artist, so comparing artist
+// already covers it.
+var comparedTagKeys = []string{"title", "artist", "album", "track", "composer", "genre", "date", "comment"}
+
+// tagsMatch reports whether every tag in comparedTagKeys has the expected value in actual.
+// ffprobe lowercases format tag keys, and often renders "track" as "N/total", so both are
+// normalized before comparing.
+func tagsMatch(expected map[string]string, actual map[string]string) bool {
+	normalized := make(map[string]string, len(actual))
+	for key, value := range actual {
+		normalized[strings.ToLower(key)] = value
+	}
+
+	for _, key := range comparedTagKeys {
+		want := strings.TrimSpace(expected[key])
+		got := strings.TrimSpace(normalized[key])
+		if key == "track" {
+			got = strings.SplitN(got, "/", 2)[0]
+		}
+		if !strings.EqualFold(got, want) {
+			return false
+		}
+	}
+	return true
+}
+
+// codecMatches reports whether the existing target's audio stream already uses the codec (and,
+// for mp3, the bitrate) that go-meta would encode with for extension.
+func codecMatches(extension string, probe *ffprobeOutput) bool {
+	wantCodec, ok := extensionCodecs[extension]
+	if !ok {
+		return true
+	}
+
+	for _, stream := range probe.Streams {
+		if stream.CodecType != "audio" {
+			continue
+		}
+		if stream.CodecName != wantCodec {
+			return false
+		}
+		if extension == "mp3" && stream.BitRate != "" && stream.BitRate != "320000" {
+			return false
+		}
+		return true
+	}
+	return false
+}
+
+// manifestFileName is where go-meta records the resumable skip-detection state for an
+// OutputPath, one level up from any single extension's output folder.
+const manifestFileName = ".go-meta-state.json"
+
+// manifestEntry captures everything that, if it changes, should force a target file to be
+// re-encoded: the source audio, the embedded art/lyrics, the effective tags, and the argv (or,
+// for a loudness-normalized track, the knobs that determine the argv) that produced it, hashed
+// together with the probed ffmpeg version.
+type manifestEntry struct {
+	InputHash    string `json:"input_hash"`
+	ArtHash      string `json:"art_hash"`
+	MetadataHash string `json:"metadata_hash"`
+	ArgsHash     string `json:"args_hash"`
+}
+
+// matches reports whether every hash in entry is identical to want, i.e. nothing that would
+// affect targetPath's contents has drifted since it was last recorded.
+func (entry manifestEntry) matches(want manifestEntry) bool {
+	return entry.InputHash == want.InputHash &&
+		entry.ArtHash == want.ArtHash &&
+		entry.MetadataHash == want.MetadataHash &&
+		entry.ArgsHash == want.ArgsHash
+}
+
+// manifest is go-meta's resumable skip-detection state for one OutputPath: a target is only
+// skipped when its manifestEntry matches the current run, so a touched metadata.json, a swapped
+// cover, or a new ffmpeg version detected by the startup probe all correctly force a re-encode
+// even when mtimes look fine.
+type manifest struct {
+	path    string
+	mu      sync.Mutex
+	Entries map[string]manifestEntry `json:"entries"`
+}
+
+// loadManifest reads path's manifest, if any. A missing or corrupt manifest just starts empty:
+// every target is treated as unrecorded until this run (or a later one) records it, falling back
+// to the ffprobe-based tag/codec check below rather than a full re-encode.
+func loadManifest(path string) *manifest {
+	m := &manifest{path: path, Entries: map[string]manifestEntry{}}
+
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return m
+	}
+	if err := json.Unmarshal(contents, m); err != nil {
+		fmt.Fprintf(os.Stderr, "warning: %s is not valid JSON, starting a fresh manifest: %s\n", path, err)
+		m.Entries = map[string]manifestEntry{}
+	}
+	return m
+}
+
+// lookup returns targetPath's recorded manifestEntry, if go-meta has one.
+func (m *manifest) lookup(targetPath string) (manifestEntry, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry, ok := m.Entries[targetPath]
+	return entry, ok
+}
+
+// record stores targetPath's manifestEntry and atomically rewrites the manifest file (write a
+// temp file, then rename over the original), so an interrupted run only loses the entries for
+// work that hadn't finished yet.
+func (m *manifest) record(targetPath string, entry manifestEntry) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.Entries[targetPath] = entry
+
+	contents, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "warning: marshaling %s: %s\n", m.path, err)
+		return
+	}
+
+	tempPath := m.path + ".tmp"
+	if err := os.WriteFile(tempPath, contents, 0666); err != nil {
+		fmt.Fprintf(os.Stderr, "warning: writing %s: %s\n", tempPath, err)
+		return
+	}
+	if err := os.Rename(tempPath, m.path); err != nil {
+		fmt.Fprintf(os.Stderr, "warning: moving %s into place: %s\n", m.path, err)
+	}
+}
+
+// hashFile returns the lowercase hex SHA-256 of path's contents.
+func hashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// hashArt hashes every cover (its file bytes plus its Role and Description, both of which feed
+// coverInputArgs' -disposition/title/comment metadata) and the lyrics sidecar (if any) together,
+// so a change to any one of them invalidates the manifest entry for every extension the track is
+// encoded to.
+func hashArt(covers []CoverSpec, lyricsPath string) (string, error) {
+	hasher := sha256.New()
+	for _, cover := range covers {
+		data, err := os.ReadFile(cover.Path)
+		if err != nil {
+			return "", err
+		}
+		hasher.Write(data)
+		hasher.Write([]byte{0})
+		hasher.Write([]byte(cover.Role))
+		hasher.Write([]byte{0})
+		hasher.Write([]byte(cover.Description))
+		hasher.Write([]byte{0})
+	}
+	if lyricsPath != "" {
+		data, err := os.ReadFile(lyricsPath)
+		if err != nil {
+			return "", err
+		}
+		hasher.Write(data)
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// hashMetadataTuple hashes a track's effective tags in orderedTagKeys order, so map iteration
+// order can't make two equal tag sets hash differently.
+func hashMetadataTuple(tags map[string]string) string {
+	hasher := sha256.New()
+	for _, key := range orderedTagKeys {
+		hasher.Write([]byte(key))
+		hasher.Write([]byte{0})
+		hasher.Write([]byte(tags[key]))
+		hasher.Write([]byte{0})
+	}
+	return hex.EncodeToString(hasher.Sum(nil))
 }
 
-// Captures information about an asynchronous ffmpeg encoding activity.
+// hashArgs hashes a sequence of strings (a real encoder argv, or the small set of loudness knobs
+// that determine an argv before it can actually be built).
+func hashArgs(args ...string) string {
+	hasher := sha256.New()
+	for _, arg := range args {
+		hasher.Write([]byte(arg))
+		hasher.Write([]byte{0})
+	}
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+// Captures information about an asynchronous encoding activity. The fields besides Task, Args,
+// Encoder and Error describe the job well enough for any Encoder's Prepare to build its own argv
+// from it; Args is opaque to everything except the Encoder that built it.
 type WorkItem struct {
-	Task  string   // Description of the activity
-	Args  []string // Command arguments for ffmpeg
-	Error error    // A launch or ffmpeg error description
+	Task string // Description of the activity
+
+	InputPath       string            // Source file: the rendered WAV unless the Encoder's InputExtension overrides it (empty for a tag-only rewrite)
+	TargetPath      string            // File the encoder should produce (or rewrite)
+	Extension       string            // OutputExtensions entry this item is producing
+	Tags            map[string]string // Effective metadata tags, keyed like trackTagMap's result
+	Covers          []CoverSpec       // Art to embed (front cover first, if any), empty if none
+	LyricsPath      string            // Path to a lyrics sidecar to embed, or "" if none
+	RewriteTagsOnly bool              // True for the lightweight "tags changed, audio didn't" path
+	LoudnessTarget  float64           // Target integrated loudness (LUFS); 0 means use the default
+	LoudnessMode    string            // "ebu-r128" (default) or "replaygain"; see LoudnessConfig.Mode
+
+	Encoder Encoder  // The Encoder responsible for Prepare/Run; set by processAlbum
+	Args    []string // Command arguments built by Encoder.Prepare
+	Error   error    // A launch or encoder error description
+
+	// RenameTo, when non-empty, is the final destination that the encoder's output (the last
+	// argument in Args) should be moved to once the encoder exits successfully. Used by the
+	// metadata-only rewrite path, which writes to a temporary file rather than the target file
+	// ffmpeg already has open for reading.
+	RenameTo string
+
+	// The following fields are only used for a loudness analysis (pass-1) item: see
+	// runLoudnessAnalysis and the loudness pipeline in main().
+	IsLoudnessAnalysis bool
+	LoudnessResult     *loudnessMeasurement
+	PendingIndex       int
+
+	// ManifestEntry is what main() should record for TargetPath once this item completes
+	// successfully; ManifestKey is empty for items (like a loudness analysis pass) that don't
+	// produce a manifest-tracked target.
+	ManifestKey   string
+	ManifestEntry manifestEntry
+}
+
+// Encoder is a backend that can turn a WorkItem into an encoded (or re-tagged) file. ffmpeg is
+// the default for every extension; Metadata.Encoders lets a run register alternatives such as
+// the flac CLI, qaac, or MP4Box.
+type Encoder interface {
+	// Prepare returns the command-line arguments needed to produce item's TargetPath. It does
+	// not run anything.
+	Prepare(item WorkItem) ([]string, error)
+	// Run executes item.Args (as built by Prepare) against item's external tool.
+	Run(ctx context.Context, item WorkItem) error
+	// Extensions lists the OutputExtensions entries this Encoder knows how to produce.
+	Extensions() []string
+	// InputExtension is the extension (without a leading dot) processAlbum should look for
+	// alongside track.RenderedFile to use as this Encoder's source file. ffmpegEncoder always
+	// reads the rendered ".wav"; an externalEncoder can override it via EncoderConfig.
+	InputExtension() string
+}
+
+// runExternalTool runs command with args, collecting stdout/stderr the same way for every
+// Encoder, and turns a non-zero exit into an error built from its stderr.
+func runExternalTool(ctx context.Context, toolName string, command string, args []string) error {
+	cmd := exec.CommandContext(ctx, command, args...)
+
+	var stderrStringBuilder strings.Builder
+	cmd.Stderr = &stderrStringBuilder
+	var stdoutStringBuilder strings.Builder
+	cmd.Stdout = &stdoutStringBuilder
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s: %s (%s)", toolName, err, formatOutAndError(stdoutStringBuilder.String(), stderrStringBuilder.String()))
+	}
+	if cmd.ProcessState.ExitCode() != 0 {
+		return fmt.Errorf("%s: %s", toolName, stderrStringBuilder.String())
+	}
+	return nil
+}
+
+// coverRoleTitles maps a CoverSpec.Role to the title tag most players display for it. Unknown or
+// empty roles are treated as "front".
+var coverRoleTitles = map[string]string{
+	"front":  "Album Cover",
+	"back":   "Back Cover",
+	"artist": "Artist Photo",
+	"disc":   "Disc Art",
+}
+
+// coverRoleComments maps a CoverSpec.Role to its default comment, used when Description isn't set.
+var coverRoleComments = map[string]string{
+	"front":  "Cover (Front)",
+	"back":   "Cover (Back)",
+	"artist": "Artist",
+	"disc":   "Cover (Media)",
+}
+
+// coverInputArgs returns the "-i <path>" arguments needed to add every cover in covers as an
+// ffmpeg input, plus the output-side disposition/metadata/map arguments that attach them as
+// picture streams. audioInputs is the number of non-cover inputs already present before the
+// covers (1: the source audio).
+func coverInputArgs(covers []CoverSpec, audioInputs int) (inputArgs []string, outputArgs []string) {
+	if len(covers) == 0 {
+		return nil, nil
+	}
+
+	for i, cover := range covers {
+		inputArgs = append(inputArgs, "-i", filepath.FromSlash(cover.Path))
+
+		title := coverRoleTitles[cover.Role]
+		if title == "" {
+			title = coverRoleTitles["front"]
+		}
+		comment := cover.Description
+		if comment == "" {
+			comment = coverRoleComments[cover.Role]
+		}
+		if comment == "" {
+			comment = coverRoleComments["front"]
+		}
+
+		streamSpec := fmt.Sprintf("v:%d", i)
+		outputArgs = append(outputArgs,
+			"-disposition:"+streamSpec, "attached_pic",
+			"-metadata:s:"+streamSpec, "title="+title,
+			"-metadata:s:"+streamSpec, "comment="+comment)
+	}
+
+	outputArgs = append(outputArgs, "-map", "0:a")
+	for i := range covers {
+		outputArgs = append(outputArgs, "-map", fmt.Sprintf("%d:v", audioInputs+i))
+	}
+
+	return inputArgs, outputArgs
+}
+
+// lyricsMetadataArgs embeds lyricsPath's contents in whichever tag extension's container
+// understands: an ID3v2 USLT-backed "lyrics-eng" tag for MP3, or a plain "LYRICS" Vorbis comment
+// for FLAC/Ogg. Other extensions (WAV) get no embedding; see writeWavSidecar instead.
+func lyricsMetadataArgs(lyricsPath string, extension string) ([]string, error) {
+	if lyricsPath == "" {
+		return nil, nil
+	}
+
+	contents, err := os.ReadFile(lyricsPath)
+	if err != nil {
+		return nil, fmt.Errorf("reading lyrics %s: %w", lyricsPath, err)
+	}
+
+	switch extension {
+	case "mp3":
+		return []string{"-metadata:s:a:0", "lyrics-eng=" + string(contents)}, nil
+	case "flac", "ogg":
+		return []string{"-metadata", "LYRICS=" + string(contents)}, nil
+	default:
+		return nil, nil
+	}
+}
+
+// ffmpegEncoder is the default Encoder, used for any extension without a Metadata.Encoders
+// override.
+type ffmpegEncoder struct {
+	ffmpegPath string
+}
+
+func (e *ffmpegEncoder) Extensions() []string {
+	extensions := make([]string, 0, len(extensionCodecs))
+	for extension := range extensionCodecs {
+		extensions = append(extensions, extension)
+	}
+	return extensions
+}
+
+// InputExtension is always "wav": ffmpegEncoder reads the rendered WAV directly.
+func (e *ffmpegEncoder) InputExtension() string { return "wav" }
+
+func (e *ffmpegEncoder) Prepare(item WorkItem) ([]string, error) {
+	if item.RewriteTagsOnly {
+		args := []string{"-loglevel", "error", "-y", "-i", item.TargetPath, "-c", "copy", "-map_metadata", "-1"}
+		args = append(args, metadataArgs(item.Tags)...)
+		args = append(args, rewriteTempPath(item.TargetPath))
+		return args, nil
+	}
+
+	args := []string{"-loglevel", "error", "-y", "-i", item.InputPath}
+
+	// No cover art or lyrics embedding for WAV: both are written as sidecar files instead (see
+	// writeWavSidecar), since WAV's raw PCM container can't embed either without decoding.
+	if item.Extension != "wav" {
+		coverInputs, coverOutputs := coverInputArgs(item.Covers, 1)
+		args = append(args, coverInputs...)
+		args = append(args, coverOutputs...)
+
+		// MP3-specific tags: id3v2_version 3 is needed for both attached pictures and the
+		// lyrics USLT frame below.
+		if item.Extension == "mp3" && (len(coverOutputs) > 0 || item.LyricsPath != "") {
+			args = append(args, "-id3v2_version", "3")
+		}
+	}
+
+	// Direct audio stream copy for WAV.
+	if item.Extension == "wav" {
+		args = append(args, "-acodec", "copy")
+	}
+
+	// Track metadata.
+	args = append(args, metadataArgs(item.Tags)...)
+
+	if item.Extension != "wav" {
+		lyricsArgs, err := lyricsMetadataArgs(item.LyricsPath, item.Extension)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, lyricsArgs...)
+	}
+
+	// Format-specific compression.
+	switch item.Extension {
+	case "flac":
+		args = append(args, "-compression_level", "12")
+	case "mp3":
+		args = append(args, "-compression_level", "0", "-abr", "1", "-b:a", "320k")
+	case "ogg":
+		args = append(args, "-q", "10")
+	}
+
+	args = append(args, item.TargetPath)
+	return args, nil
+}
+
+func (e *ffmpegEncoder) Run(ctx context.Context, item WorkItem) error {
+	return runExternalTool(ctx, "ffmpeg", e.ffmpegPath, item.Args)
+}
+
+// rewriteTempPath is the path ffmpeg writes to for a tag-only rewrite, since it can't read and
+// write the same file in a single invocation.
+func rewriteTempPath(targetPath string) string {
+	return targetPath + ".go-meta-tmp" + filepath.Ext(targetPath)
+}
+
+// loudnessMeasurement is the ffmpeg ebur128 filter's analysis of one track, in the units
+// loudnorm's measured_* parameters expect.
+type loudnessMeasurement struct {
+	IntegratedLUFS float64
+	ThresholdLUFS  float64
+	LRA            float64
+	TruePeakDBFS   float64
+}
+
+// loudnessStatPattern matches the labeled lines in ffmpeg's ebur128 "Summary:" block, e.g.
+// "  I:         -23.7 LUFS" or "  Peak:       -3.3 dBFS".
+var loudnessStatPattern = regexp.MustCompile(`(?m)^\s*(I|Threshold|LRA|Peak):\s*(-?[0-9.]+)`)
+
+// parseLoudnessMeasurement extracts integrated loudness, threshold, loudness range and true peak
+// from an ebur128 "-f null -" run's stderr. "Threshold:" appears twice in the real output (once
+// for integrated loudness, once for loudness range); the first occurrence is the one
+// loudnorm's measured_thresh parameter wants.
+func parseLoudnessMeasurement(stderr string) (loudnessMeasurement, error) {
+	values := map[string][]float64{}
+	for _, match := range loudnessStatPattern.FindAllStringSubmatch(stderr, -1) {
+		value, err := strconv.ParseFloat(match[2], 64)
+		if err != nil {
+			continue
+		}
+		values[match[1]] = append(values[match[1]], value)
+	}
+
+	first := func(key string) (float64, bool) {
+		found := values[key]
+		if len(found) == 0 {
+			return 0, false
+		}
+		return found[0], true
+	}
+
+	var measurement loudnessMeasurement
+	var ok bool
+	if measurement.IntegratedLUFS, ok = first("I"); !ok {
+		return measurement, fmt.Errorf("could not find integrated loudness (\"I:\") in ffmpeg output")
+	}
+	if measurement.ThresholdLUFS, ok = first("Threshold"); !ok {
+		return measurement, fmt.Errorf("could not find loudness threshold (\"Threshold:\") in ffmpeg output")
+	}
+	if measurement.LRA, ok = first("LRA"); !ok {
+		return measurement, fmt.Errorf("could not find loudness range (\"LRA:\") in ffmpeg output")
+	}
+	if measurement.TruePeakDBFS, ok = first("Peak"); !ok {
+		return measurement, fmt.Errorf("could not find true peak (\"Peak:\") in ffmpeg output")
+	}
+	return measurement, nil
+}
+
+// albumLoudness is the album-level ReplayGain tags computed by averaging each track's
+// loudnessMeasurement.
+type albumLoudness struct {
+	HasData    bool
+	GainDB     float64
+	PeakLinear float64
+}
+
+// computeAlbumLoudness averages the integrated loudness of every successfully-measured track in
+// an album (relative to targetLUFS) and takes the loudest true peak, the same way ReplayGain's
+// album-gain tags are conventionally derived from per-track analysis.
+func computeAlbumLoudness(measurements []loudnessMeasurement, targetLUFS float64) albumLoudness {
+	if len(measurements) == 0 {
+		return albumLoudness{}
+	}
+
+	var sumLUFS float64
+	maxPeakDBFS := measurements[0].TruePeakDBFS
+	for _, measurement := range measurements {
+		sumLUFS += measurement.IntegratedLUFS
+		if measurement.TruePeakDBFS > maxPeakDBFS {
+			maxPeakDBFS = measurement.TruePeakDBFS
+		}
+	}
+
+	return albumLoudness{
+		HasData:    true,
+		GainDB:     targetLUFS - sumLUFS/float64(len(measurements)),
+		PeakLinear: math.Pow(10, maxPeakDBFS/20),
+	}
+}
+
+// trackReplayGain computes one track's ReplayGain gain (dB, relative to targetLUFS) and true peak
+// (linear amplitude) from its pass-1 measurement - the per-track counterpart to
+// computeAlbumLoudness's album-wide average.
+func trackReplayGain(measurement loudnessMeasurement, targetLUFS float64) (gainDB float64, peakLinear float64) {
+	return targetLUFS - measurement.IntegratedLUFS, math.Pow(10, measurement.TruePeakDBFS/20)
+}
+
+// loudnessEncoder is implemented by Encoders that support the two-pass loudness pipeline.
+// Currently only ffmpegEncoder does; extensions using an externalEncoder skip the pipeline.
+type loudnessEncoder interface {
+	PrepareLoudnessAnalysis(item WorkItem) ([]string, error)
+	PrepareLoudnessEncode(item WorkItem, measurement loudnessMeasurement, albumGain albumLoudness) ([]string, error)
+}
+
+// PrepareLoudnessAnalysis builds the pass-1 "measure only" ffmpeg invocation. ebur128 writes its
+// summary to stderr, not stdout.
+func (e *ffmpegEncoder) PrepareLoudnessAnalysis(item WorkItem) ([]string, error) {
+	return []string{"-nostats", "-i", item.InputPath, "-af", "ebur128=peak=true", "-f", "null", "-"}, nil
+}
+
+// PrepareLoudnessEncode builds the pass-2 encode. In "ebu-r128" mode (the default) it applies the
+// loudnorm filter with the pass-1 measurement baked in, so ffmpeg does a single linear gain pass
+// rather than its own (less accurate) dynamic analysis, permanently altering the audio. In
+// "replaygain" mode the audio passes through unfiltered and the measurement is only used to tag
+// replaygain_track_gain/replaygain_track_peak, the traditional ReplayGain contract of leaving
+// masters untouched and applying the gain at playback time instead.
+func (e *ffmpegEncoder) PrepareLoudnessEncode(item WorkItem, measurement loudnessMeasurement, albumGain albumLoudness) ([]string, error) {
+	targetLUFS := -14.0
+	if item.LoudnessTarget != 0 {
+		targetLUFS = item.LoudnessTarget
+	}
+
+	args := []string{"-loglevel", "error", "-y", "-i", item.InputPath}
+	if item.LoudnessMode == "replaygain" {
+		trackGainDB, trackPeakLinear := trackReplayGain(measurement, targetLUFS)
+		args = append(args,
+			"-metadata", fmt.Sprintf("replaygain_track_gain=%.2f dB", trackGainDB),
+			"-metadata", fmt.Sprintf("replaygain_track_peak=%.6f", trackPeakLinear),
+		)
+	} else {
+		filter := fmt.Sprintf(
+			"loudnorm=I=%g:TP=-1.5:measured_I=%g:measured_TP=%g:measured_LRA=%g:measured_thresh=%g:linear=true",
+			targetLUFS, measurement.IntegratedLUFS, measurement.TruePeakDBFS, measurement.LRA, measurement.ThresholdLUFS)
+		args = append(args, "-af", filter)
+	}
+
+	coverInputs, coverOutputs := coverInputArgs(item.Covers, 1)
+	args = append(args, coverInputs...)
+	args = append(args, coverOutputs...)
+	if item.Extension == "mp3" && (len(coverOutputs) > 0 || item.LyricsPath != "") {
+		args = append(args, "-id3v2_version", "3")
+	}
+
+	args = append(args, metadataArgs(item.Tags)...)
+
+	lyricsArgs, err := lyricsMetadataArgs(item.LyricsPath, item.Extension)
+	if err != nil {
+		return nil, err
+	}
+	args = append(args, lyricsArgs...)
+
+	// Album gain tags only make sense in "replaygain" mode: in "ebu-r128" mode the audio has
+	// already been normalized toward targetLUFS by the loudnorm filter above, so tagging it with
+	// a correction computed from the pre-normalization measurement would have a player apply a
+	// second, redundant gain adjustment on top of audio that's already at target.
+	if item.LoudnessMode == "replaygain" && albumGain.HasData {
+		args = append(args,
+			"-metadata", fmt.Sprintf("replaygain_album_gain=%.2f dB", albumGain.GainDB),
+			"-metadata", fmt.Sprintf("replaygain_album_peak=%.6f", albumGain.PeakLinear),
+		)
+	}
+
+	switch item.Extension {
+	case "flac":
+		args = append(args, "-compression_level", "12")
+	case "mp3":
+		args = append(args, "-compression_level", "0", "-abr", "1", "-b:a", "320k")
+	case "ogg":
+		args = append(args, "-q", "10")
+	}
+
+	args = append(args, item.TargetPath)
+	return args, nil
+}
+
+// runLoudnessAnalysis runs a pass-1 "ebur128" invocation and parses the measurement out of its
+// stderr. Unlike runExternalTool, the stderr we need is produced on the *successful* exit path,
+// so this talks to exec.Cmd directly rather than going through the shared Run() helper.
+func runLoudnessAnalysis(ctx context.Context, ffmpegPath string, args []string) (loudnessMeasurement, error) {
+	cmd := exec.CommandContext(ctx, ffmpegPath, args...)
+
+	var stderrStringBuilder strings.Builder
+	cmd.Stderr = &stderrStringBuilder
+
+	if err := cmd.Run(); err != nil {
+		return loudnessMeasurement{}, fmt.Errorf("ffmpeg: %s (%s)", err, strings.TrimSpace(stderrStringBuilder.String()))
+	}
+
+	return parseLoudnessMeasurement(stderrStringBuilder.String())
+}
+
+// externalEncoder is a Metadata.Encoders-configured Encoder that shells out to a single external
+// tool. buildArgs does the tool-specific argv construction; everything else (resolving the
+// command, running it, reporting Extensions) is shared.
+type externalEncoder struct {
+	toolName       string
+	extension      string
+	command        string
+	extraArgs      []string
+	inputExtension string
+	buildArgs      func(e *externalEncoder, item WorkItem) ([]string, error)
+}
+
+func (e *externalEncoder) Extensions() []string { return []string{e.extension} }
+
+// InputExtension is "wav" unless EncoderConfig.InputExtension overrode it, e.g. an "mp4box" kind
+// muxing an already-encoded ".ec3" elementary stream instead of a raw WAV.
+func (e *externalEncoder) InputExtension() string { return e.inputExtension }
+
+func (e *externalEncoder) Prepare(item WorkItem) ([]string, error) {
+	if item.RewriteTagsOnly {
+		return nil, fmt.Errorf("%s does not support in-place tag rewrites; delete %s to force a re-encode", e.toolName, item.TargetPath)
+	}
+	return e.buildArgs(e, item)
+}
+
+func (e *externalEncoder) Run(ctx context.Context, item WorkItem) error {
+	return runExternalTool(ctx, e.toolName, e.command, item.Args)
+}
+
+// flacArgs builds flac CLI arguments. flac writes Vorbis comments via repeated --tag flags.
+func flacArgs(e *externalEncoder, item WorkItem) ([]string, error) {
+	args := []string{"-f"} // overwrite an existing target
+	args = append(args, e.extraArgs...)
+	for _, key := range orderedTagKeys {
+		if value := item.Tags[key]; value != "" {
+			args = append(args, "--tag="+key+"="+value)
+		}
+	}
+	args = append(args, "-o", item.TargetPath, item.InputPath)
+	return args, nil
+}
+
+// qaacTagFlags maps go-meta's tag keys to qaac's explicit tag flags (qaac has no generic --tag).
+var qaacTagFlags = map[string]string{
+	"title":    "--title",
+	"artist":   "--artist",
+	"album":    "--album",
+	"genre":    "--genre",
+	"date":     "--date",
+	"composer": "--composer",
+	"comment":  "--comment",
+}
+
+// qaacArgs builds qaac arguments for .m4a encoding. It adds no codec flag of its own, so ALAC
+// output needs qaac's "--alac" in EncoderConfig.Args; otherwise qaac's default codec is used.
+func qaacArgs(e *externalEncoder, item WorkItem) ([]string, error) {
+	var args []string
+	args = append(args, e.extraArgs...)
+	for _, key := range []string{"title", "artist", "album", "genre", "date", "composer", "comment"} {
+		if value := item.Tags[key]; value != "" {
+			args = append(args, qaacTagFlags[key], value)
+		}
+	}
+	args = append(args, "-o", item.TargetPath, item.InputPath)
+	return args, nil
+}
+
+// mp4boxArgs builds MP4Box arguments for muxing an already-encoded elementary stream (e.g. a
+// Dolby Atmos .ec3) into an .m4a container. MP4Box doesn't carry its own tag-writing step here;
+// tags are expected to already be embedded in the input stream.
+func mp4boxArgs(e *externalEncoder, item WorkItem) ([]string, error) {
+	var args []string
+	args = append(args, e.extraArgs...)
+	args = append(args, "-add", item.InputPath, "-new", item.TargetPath)
+	return args, nil
+}
+
+// newExternalEncoder resolves config's command and returns the Encoder it describes.
+func newExternalEncoder(extension string, config EncoderConfig) (Encoder, error) {
+	var toolName string
+	var buildArgs func(e *externalEncoder, item WorkItem) ([]string, error)
+
+	switch config.Kind {
+	case "flac":
+		toolName, buildArgs = "flac", flacArgs
+	case "qaac":
+		toolName, buildArgs = "qaac", qaacArgs
+	case "mp4box":
+		toolName, buildArgs = "MP4Box", mp4boxArgs
+	default:
+		return nil, fmt.Errorf("extension %q: unknown encoder kind %q (want \"flac\", \"qaac\", or \"mp4box\")", extension, config.Kind)
+	}
+
+	command, err := resolveToolPath(toolName, config.Command)
+	if err != nil {
+		// resolveToolPath's hint names a "<tool>_path" field, which only exists for ffmpeg and
+		// ffprobe; an encoder's tool is set via its "command" field instead.
+		return nil, fmt.Errorf("extension %q: could not find %s on $PATH or alongside the go-meta binary; set \"command\" in its \"encoders\" entry", extension, toolName)
+	}
+
+	inputExtension := config.InputExtension
+	if inputExtension == "" {
+		inputExtension = "wav"
+	}
+
+	return &externalEncoder{
+		toolName:       toolName,
+		extension:      extension,
+		command:        command,
+		extraArgs:      config.Args,
+		inputExtension: inputExtension,
+		buildArgs:      buildArgs,
+	}, nil
+}
+
+// buildEncoders resolves the Encoder responsible for each of metadata.OutputExtensions: ffmpeg
+// by default, or whatever metadata.Encoders declares for that extension.
+func buildEncoders(metadata Metadata, ffmpegPath string) (map[string]Encoder, error) {
+	encoders := make(map[string]Encoder, len(metadata.OutputExtensions))
+	ffmpeg := &ffmpegEncoder{ffmpegPath: ffmpegPath}
+
+	for _, extension := range metadata.OutputExtensions {
+		config, overridden := metadata.Encoders[extension]
+		if !overridden {
+			encoders[extension] = ffmpeg
+			continue
+		}
+
+		encoder, err := newExternalEncoder(extension, config)
+		if err != nil {
+			return nil, err
+		}
+		encoders[extension] = encoder
+	}
+
+	return encoders, nil
 }
 
 func main() {
@@ -68,16 +1064,6 @@ func main() {
 
 	path := flag.Arg(0)
 
-	// Get the last modified time of the metadata. This is used to ensure that encoding takes place even when there
-	// is an encoded file more recent than the original rendered file.
-	metadataModTime := time.Now()
-	stat, err := os.Stat(path)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "error: Looking for %s: %s", path, err)
-	} else {
-		metadataModTime = stat.ModTime()
-	}
-
 	// Read the metadata.
 	bytes, err := os.ReadFile(path)
 	if err != nil {
@@ -93,6 +1079,39 @@ func main() {
 		return
 	}
 
+	// Resolve the ffmpeg binary, then probe it once up front so we fail fast with a single clear
+	// diagnostic instead of a cryptic ffmpeg stderr per track.
+	ffmpegCommand, err := resolveFfmpegPath(metadata.FfmpegPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		return
+	}
+	caps, err := probeFfmpeg(ffmpegCommand)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: Probing %s: %s\n", ffmpegCommand, err)
+		return
+	}
+	if err := validateCodecSupport(caps, metadata.OutputExtensions, metadata.Encoders); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		return
+	}
+
+	// ffprobe is optional: without it, processAlbum can only rely on the manifest, so a target
+	// that predates the manifest (or was produced by a different tool) is always re-encoded.
+	ffprobeCommand, err := resolveFfprobePath(metadata.FfprobePath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "warning: %s (skip detection falls back to the manifest alone)\n", err)
+		ffprobeCommand = ""
+	}
+
+	// Resolve every extension's Encoder up front, alongside ffmpeg and ffprobe, so a bad
+	// "encoders" config is reported before any work starts.
+	encoders, err := buildEncoders(metadata, ffmpegCommand)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		return
+	}
+
 	// Create the main output folder, if not already present.
 	err = os.MkdirAll(metadata.OutputPath, 0777)
 	if err != nil {
@@ -100,45 +1119,123 @@ func main() {
 		return
 	}
 
-	// Collect WorkItem instances for all albums.
+	// Load the resumable skip-detection manifest; a missing or corrupt one just starts empty.
+	stateManifest := loadManifest(filepath.Join(metadata.OutputPath, manifestFileName))
+
+	// Collect WorkItem instances for all albums, plus any tracks whose encode depends on a
+	// loudness analysis pass that hasn't run yet.
 	var workItems []WorkItem
+	var pendingLoudness []pendingLoudnessItem
 	for _, album := range metadata.Albums {
-		albumWorkItems := processAlbum(metadata, album, metadataModTime)
+		albumWorkItems, albumPending := processAlbum(metadata, album, ffprobeCommand, ffmpegCommand, encoders, stateManifest)
 		workItems = append(workItems, albumWorkItems...)
+		pendingLoudness = append(pendingLoudness, albumPending...)
 	}
 
-	// Convert path separators to native type.
-	ffmpegCommand := filepath.FromSlash(metadata.FfmpegPath)
+	ctx := context.Background()
 
-	fmt.Printf("Processing %d track(s)\n", len(workItems))
+	// Run the loudness pipeline's pass-1 analysis batch to completion before building pass-2
+	// encode WorkItems: album-level ReplayGain tags can only be averaged once every track in the
+	// album has been measured, so pass-2 can't be dispatched alongside pass-1.
+	if len(pendingLoudness) > 0 {
+		fmt.Printf("Analyzing loudness of %d track(s) with ffmpeg %s\n", len(pendingLoudness), caps.Version)
+
+		measurements := make([]*loudnessMeasurement, len(pendingLoudness))
+		analysisItems := make([]WorkItem, len(pendingLoudness))
+		for i, pending := range pendingLoudness {
+			analysisItems[i] = WorkItem{
+				Task:               fmt.Sprintf("analyzing loudness of %s", pending.InputPath),
+				InputPath:          pending.InputPath,
+				Args:               pending.AnalysisArgs,
+				IsLoudnessAnalysis: true,
+				PendingIndex:       i,
+			}
+		}
+
+		coutil.WorkPool(
+			*numThreadsFlag,
+			analysisItems,
+			func(item WorkItem) WorkItem {
+				measurement, err := runLoudnessAnalysis(ctx, ffmpegCommand, item.Args)
+				if err != nil {
+					item.Error = fmt.Errorf("error: %s: %s", item.Task, err)
+				} else {
+					item.LoudnessResult = &measurement
+				}
+				return item
+			},
+			func(item WorkItem) {
+				if item.Error != nil {
+					fmt.Fprintf(os.Stderr, "%s\n", item.Error)
+					return
+				}
+				measurements[item.PendingIndex] = item.LoudnessResult
+			})
+
+		// Group successful measurements by album so the gain tags reflect only the tracks that
+		// are actually going to be encoded.
+		albumMeasurements := map[string][]loudnessMeasurement{}
+		for i, pending := range pendingLoudness {
+			if measurements[i] != nil {
+				albumMeasurements[pending.AlbumKey] = append(albumMeasurements[pending.AlbumKey], *measurements[i])
+			}
+		}
+
+		targetLUFS := loudnessTargetLUFS(metadata.Loudness)
+		albumGains := map[string]albumLoudness{}
+		for albumKey, measurements := range albumMeasurements {
+			albumGains[albumKey] = computeAlbumLoudness(measurements, targetLUFS)
+		}
+
+		for i, pending := range pendingLoudness {
+			if measurements[i] == nil {
+				continue
+			}
+
+			item := WorkItem{
+				Task:           pending.Task,
+				InputPath:      pending.InputPath,
+				TargetPath:     pending.TargetPath,
+				Extension:      pending.Extension,
+				Tags:           pending.Tags,
+				Covers:         pending.Covers,
+				LyricsPath:     pending.LyricsPath,
+				LoudnessTarget: targetLUFS,
+				LoudnessMode:   metadata.Loudness.Mode,
+			}
+
+			args, err := pending.Encoder.PrepareLoudnessEncode(item, *measurements[i], albumGains[pending.AlbumKey])
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "error: Preparing loudness encode for %s: %s", pending.TargetPath, err)
+				continue
+			}
+			item.Args = args
+			item.Encoder = pending.Encoder.(Encoder)
+			item.ManifestKey = pending.TargetPath
+			item.ManifestEntry = pending.ManifestEntry
+
+			workItems = append(workItems, item)
+		}
+	}
+
+	fmt.Printf("Processing %d track(s) with ffmpeg %s\n", len(workItems), caps.Version)
 
 	// Process the work items and report completion or errors.
 	coutil.WorkPool(
 		*numThreadsFlag,
 		workItems,
 		func(item WorkItem) WorkItem {
-			//fmt.Println(formatCommand(ffmpegCommand, item.Args))
+			//fmt.Println(formatCommand(item.Encoder, item.Args))
 			//fmt.Println()
 
-			cmd := exec.Command(ffmpegCommand, item.Args...)
-
-			// Collect stderr into a string Builder.
-			var stderrStringBuilder strings.Builder
-			cmd.Stderr = &stderrStringBuilder
-			var stdoutStringBuilder strings.Builder
-			cmd.Stdout = &stdoutStringBuilder
-
-			err = cmd.Run()
-
-			if err != nil {
-				stdout := stdoutStringBuilder.String()
-				stderr := stderrStringBuilder.String()
-				// Record launch error
-				item.Error = fmt.Errorf("error: %s: %s (%s)", item.Task, err, formatOutAndError(stdout, stderr))
-			} else {
-				// Check ffmpeg exit code. Record stderr text if we have a non-zero exit code.
-				if cmd.ProcessState.ExitCode() != 0 {
-					item.Error = fmt.Errorf("error: ffmpeg: %s", stderrStringBuilder.String())
+			if err := item.Encoder.Run(ctx, item); err != nil {
+				item.Error = fmt.Errorf("error: %s: %s", item.Task, err)
+			} else if item.RenameTo != "" {
+				// Metadata-only rewrite: the encoder wrote to a temporary file since it can't
+				// read and write the same path at once. Move it into place now.
+				tempPath := item.Args[len(item.Args)-1]
+				if err := os.Rename(tempPath, item.RenameTo); err != nil {
+					item.Error = fmt.Errorf("error: %s: moving %s into place: %s", item.Task, tempPath, err)
 				}
 			}
 			return item
@@ -146,17 +1243,48 @@ func main() {
 		func(item WorkItem) {
 			if item.Error != nil {
 				fmt.Fprintf(os.Stderr, "%s\n", item.Error)
-			} else {
-				fmt.Printf("%s\n", item.Task)
+				return
+			}
+			fmt.Printf("%s\n", item.Task)
+			if item.ManifestKey != "" {
+				stateManifest.record(item.ManifestKey, item.ManifestEntry)
 			}
 		})
 }
 
+// pendingLoudnessItem describes a track/extension that needs loudness analysis before it can be
+// encoded: the album-level ReplayGain tags can only be computed once every track in the album has
+// been measured, so these are collected and dispatched as a second, later WorkPool batch rather
+// than being turned into a WorkItem immediately.
+type pendingLoudnessItem struct {
+	AlbumKey     string // groups tracks for album-level gain averaging
+	Task         string
+	InputPath    string
+	TargetPath   string
+	Extension    string
+	Tags         map[string]string
+	Covers       []CoverSpec
+	LyricsPath   string
+	Encoder      loudnessEncoder
+	AnalysisArgs []string
+
+	// ManifestEntry is what main() should record for TargetPath once the pass-2 encode built
+	// from this pending item completes successfully.
+	ManifestEntry manifestEntry
+}
+
 // Creates output directories for an album and returns a slice of WorkItem(s) that contain arguments for ffmpeg
-// to perform encoding.
-func processAlbum(metadata Metadata, album Album, metadataModTime time.Time) []WorkItem {
+// to perform encoding, plus any tracks that need a loudness analysis pass before they can be encoded.
+// m is the resumable skip-detection manifest for metadata.OutputPath.
+func processAlbum(metadata Metadata, album Album, ffprobePath string, ffmpegPath string, encoders map[string]Encoder, m *manifest) ([]WorkItem, []pendingLoudnessItem) {
 	// A slice that contains encoding work items.
 	var workItems []WorkItem
+	var pending []pendingLoudnessItem
+
+	// Tag-only rewrites always go through ffmpeg's "-c copy" remux, regardless of which Encoder
+	// normally produces the extension: it's the one tool here that can restamp metadata on an
+	// already-encoded container without touching the audio.
+	rewriter := &ffmpegEncoder{ffmpegPath: ffmpegPath}
 
 	// Try to create a WorkItem for each track in the album.
 	for trackIndex, track := range album.Tracks {
@@ -175,9 +1303,44 @@ func processAlbum(metadata Metadata, album Album, metadataModTime time.Time) []W
 			}
 		}
 
+		// Resolve the track's art (front cover, plus any additional Covers) and lyrics sidecar
+		// once, shared across every OutputExtensions entry.
+		var covers []CoverSpec
+		if frontCover := override(album.Cover, track.Cover); frontCover != "" {
+			covers = append(covers, CoverSpec{Path: frontCover, Role: "front"})
+		}
+		covers = append(covers, track.Covers...)
+		for _, cover := range covers {
+			warnIfCoverTooLarge(cover)
+		}
+
+		var lyricsPath string
+		if track.Lyrics != nil {
+			lyricsPath = *track.Lyrics
+		}
+
+		// Hash the source audio and the art/lyrics bundle once per track; both feed every
+		// extension's manifestEntry below.
+		inputHash, err := hashFile(inputRenderedPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: hashing %s: %s", inputRenderedPath, err)
+			continue
+		}
+		artHash, err := hashArt(covers, lyricsPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: hashing cover/lyrics for %s: %s", inputRenderedPath, err)
+			continue
+		}
+
 		// Loop over the file format extensions
 		for _, extension := range metadata.OutputExtensions {
 
+			encoder, ok := encoders[extension]
+			if !ok {
+				fmt.Fprintf(os.Stderr, "error: no encoder registered for extension %s (skipping)!", extension)
+				continue
+			}
+
 			// Construct a target output folder if one does not already exist.
 			targetFolder := filepath.Join(metadata.OutputPath, extension, album.Artist, album.Title)
 			err = os.MkdirAll(targetFolder, 0777)
@@ -193,77 +1356,321 @@ func processAlbum(metadata Metadata, album Album, metadataModTime time.Time) []W
 					album.Artist, album.Title, trackNumber,
 					track.Title, track.RenderedFile, extension))
 
-			// Check whether an existing target file is more recent than (a) the metadata, and (b) the input rendered file. If so, it can be skipped.
-			if targetStat, err := os.Stat(targetPath); err == nil {
-				if targetStat.IsDir() {
-					// Check whether the proposed target file already exists as a directory.
-					fmt.Fprintf(os.Stderr, "error: %s is a directory (skipping)!", targetPath)
+			// Resolve the file this encoder actually reads: the rendered WAV by default, or
+			// whatever EncoderConfig.InputExtension overrode it to (e.g. an already-encoded Dolby
+			// Atmos ".ec3" elementary stream for an "mp4box" encoder).
+			trackInputPath := inputRenderedPath
+			trackInputHash := inputHash
+			if inputExt := encoder.InputExtension(); inputExt != "wav" {
+				trackInputPath = filepath.Join(metadata.InputPath, track.RenderedFile+"."+inputExt)
+				extStat, statErr := os.Stat(trackInputPath)
+				if statErr != nil {
+					fmt.Fprintf(os.Stderr, "error: Looking for %s: %s", trackInputPath, statErr)
 					continue
 				}
+				if extStat.IsDir() {
+					fmt.Fprintf(os.Stderr, "error: %s is a directory (skipping)!", trackInputPath)
+					continue
+				}
+				trackInputHash, err = hashFile(trackInputPath)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "error: hashing %s: %s", trackInputPath, err)
+					continue
+				}
+			}
+
+			expectedTags := trackTagMap(trackNumber, track, album)
+			metadataHash := hashMetadataTuple(expectedTags)
+
+			// The loudness encode's real argv depends on a pass-1 measurement that hasn't run
+			// yet, so its manifestEntry uses a proxy hash of the knobs that determine it instead:
+			// the measurement itself is a deterministic function of the (already-hashed) input.
+			_, encoderSupportsLoudness := encoder.(loudnessEncoder)
+			usesLoudness := metadata.Loudness != nil && extension != "wav" && encoderSupportsLoudness
 
-				// Check whether the existing target file is more recent than the metadata or input rendered file.
-				targetModTime := targetStat.ModTime()
-				if targetModTime.After(inputRenderedStat.ModTime()) && targetModTime.After(metadataModTime) {
-					fmt.Printf("Skipping %s (is more recent)\n", targetPath)
+			// The ffmpeg version from the startup probe (cached, so ffmpeg isn't re-run) is part of
+			// argsHash, so switching ffmpeg builds forces a re-encode.
+			ffmpegCaps, _ := probeFfmpeg(ffmpegPath)
+
+			var argsHash string
+			var previewArgs []string
+			if usesLoudness {
+				argsHash = hashArgs("loudness", ffmpegCaps.Version, metadata.Loudness.Mode, fmt.Sprintf("%g", loudnessTargetLUFS(metadata.Loudness)))
+			} else {
+				var err error
+				previewArgs, err = encoder.Prepare(WorkItem{
+					InputPath:  trackInputPath,
+					TargetPath: targetPath,
+					Extension:  extension,
+					Tags:       expectedTags,
+					Covers:     covers,
+					LyricsPath: lyricsPath,
+				})
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "error: Preparing %s: %s", targetPath, err)
 					continue
 				}
+				argsHash = hashArgs(append([]string{ffmpegCaps.Version}, previewArgs...)...)
 			}
 
-			// Construct arguments for ffmpeg.exe
-			args := []string{"-loglevel", "error", "-y", "-i", inputRenderedPath}
+			desiredEntry := manifestEntry{
+				InputHash:    trackInputHash,
+				ArtHash:      artHash,
+				MetadataHash: metadataHash,
+				ArgsHash:     argsHash,
+			}
 
-			coverArt := override(album.Cover, track.Cover)
-			if len(coverArt) > 0 {
-				// No cover art for WAV.
-				if extension != "wav" {
-					args = append(args, "-i", filepath.FromSlash(coverArt), "-disposition:v", "attached_pic", "-metadata:s:v", "title=Album Cover", "-metadata:s:v", "comment=Cover (Front)")
+			// A target is only skipped when every hash in its manifestEntry still matches: a
+			// touched metadata.json, a swapped cover, or a different ffmpeg build all correctly
+			// force a re-encode even when mtimes would say otherwise.
+			if targetStat, err := os.Stat(targetPath); err == nil {
+				if targetStat.IsDir() {
+					fmt.Fprintf(os.Stderr, "error: %s is a directory (skipping)!", targetPath)
+					continue
 				}
-				// MP3-specific tags.
-				if extension == "mp3" {
-					args = append(args, "-map", "0:a", "-map", "1:v", "-id3v2_version", "3")
+
+				recorded, ok := m.lookup(targetPath)
+				if ok {
+					if recorded.matches(desiredEntry) {
+						fmt.Printf("Skipping %s (manifest hashes match)\n", targetPath)
+						continue
+					}
+					// A recorded entry exists but has drifted (new cover, edited tags, a
+					// different ffmpeg build, ...): the manifest is the only thing that can see
+					// that drift, so it must fall straight through to a real encode below rather
+					// than through the tag/codec-only ffprobe fallback, which can't see it either.
 				}
-			}
 
-			// Direct audio stream copy for WAV.
-			if extension == "wav" {
-				args = append(args, "-acodec", "copy")
+				// No manifest entry at all yet (a fresh manifest, or a target that predates it):
+				// fall back to the ffprobe-based tag/codec check so an already-correct library
+				// isn't needlessly re-encoded in full while the manifest catches up.
+				if !ok && ffprobePath != "" {
+					if probe, err := probeExistingTarget(ffprobePath, targetPath); err == nil {
+						tagsOK := tagsMatch(expectedTags, probe.Format.Tags)
+						codecOK := codecMatches(extension, probe)
+
+						// tagsMatch/codecMatches only ever compare tags and codec/bitrate - neither
+						// can tell whether the embedded cover or lyrics are still current. So
+						// nothing learned here is recorded into the manifest: that would bless the
+						// current ArtHash as verified when it never was, permanently masking a
+						// swapped cover behind a tags-and-codec match that happens to still hold.
+						// A real encode (via the main work items below) is what earns a manifest
+						// entry.
+						if tagsOK && codecOK {
+							fmt.Printf("Skipping %s (tags and codec already match)\n", targetPath)
+							continue
+						}
+
+						if codecOK {
+							// Codec and bitrate are already right, only the tags are stale.
+							// Rewrite them in place instead of re-encoding the whole file.
+							rewriteItem := WorkItem{
+								TargetPath:      targetPath,
+								Tags:            expectedTags,
+								RewriteTagsOnly: true,
+							}
+							if rewriteArgs, err := rewriter.Prepare(rewriteItem); err == nil {
+								rewriteItem.Task = fmt.Sprintf("%s (rewriting tags)", targetPath)
+								rewriteItem.Args = rewriteArgs
+								rewriteItem.Encoder = rewriter
+								rewriteItem.RenameTo = targetPath
+								workItems = append(workItems, rewriteItem)
+								continue
+							}
+						}
+					}
+				}
 			}
 
-			// Track metadata.
-			args = append(args,
-				"-metadata", "track="+fmt.Sprintf("%d", trackNumber),
-				"-metadata", "title="+track.Title,
-				"-metadata", "album="+album.Title,
-				"-metadata", "genre="+override(album.Genre, track.Genre),
-				"-metadata", "date="+override(album.Date, track.Date),
-				"-metadata", "artist="+override(album.Artist, track.Artist),
-				"-metadata", "album_artist="+override(album.Artist, track.Artist),
-				"-metadata", "composer="+override(album.Composer, track.Composer),
-				"-metadata", "comment="+override(album.Copyright, track.Copyright),
-			)
-
-			// Format-specific compression.
-			switch extension {
-			case "flac":
-				args = append(args, "-compression_level", "12")
-			case "mp3":
-				args = append(args, "-compression_level", "0", "-abr", "1", "-b:a", "320k")
-			case "ogg":
-				args = append(args, "-q", "10")
+			// Loudness normalization needs a first analysis pass before the real encode args
+			// can be built, and (for now) is only wired up for ffmpegEncoder; WAV is a raw
+			// stream copy and can't be filtered without decoding, so it's never a candidate.
+			if metadata.Loudness != nil && extension != "wav" {
+				if !encoderSupportsLoudness {
+					fmt.Fprintf(os.Stderr, "warning: encoder for %s does not support loudness normalization, encoding at source level\n", extension)
+				} else {
+					loudnessCapable := encoder.(loudnessEncoder)
+					analysisArgs, err := loudnessCapable.PrepareLoudnessAnalysis(WorkItem{InputPath: inputRenderedPath})
+					if err != nil {
+						fmt.Fprintf(os.Stderr, "error: Preparing loudness analysis for %s: %s", inputRenderedPath, err)
+						continue
+					}
+
+					pending = append(pending, pendingLoudnessItem{
+						AlbumKey:      filepath.Join(album.Artist, album.Title),
+						Task:          fmt.Sprintf("%s to %s", inputRenderedPath, targetPath),
+						InputPath:     inputRenderedPath,
+						TargetPath:    targetPath,
+						Extension:     extension,
+						Tags:          expectedTags,
+						Covers:        covers,
+						LyricsPath:    lyricsPath,
+						Encoder:       loudnessCapable,
+						AnalysisArgs:  analysisArgs,
+						ManifestEntry: desiredEntry,
+					})
+					continue
+				}
 			}
 
-			args = append(args, targetPath)
+			// WAV's raw PCM container can't embed cover art or lyrics, so write every cover and
+			// the lyrics alongside the output file instead of silently dropping them. The front
+			// cover keeps the bare "<name>.<ext>" sidecar name for backwards compatibility; any
+			// additional covers get their Role (or, lacking one, their index) appended so they
+			// don't collide with it. Two additional covers with the same Role get the same name,
+			// and the later one overwrites the earlier.
+			if extension == "wav" {
+				for i, cover := range covers {
+					suffix := ""
+					if i > 0 {
+						suffix = "." + cover.Role
+						if cover.Role == "" {
+							suffix = fmt.Sprintf(".%d", i)
+						}
+					}
+					if err := writeWavSidecar(targetPath, cover.Path, suffix); err != nil {
+						fmt.Fprintf(os.Stderr, "error: writing %s cover sidecar for %s: %s", cover.Role, targetPath, err)
+					}
+				}
+				if lyricsPath != "" {
+					if err := writeWavSidecar(targetPath, lyricsPath, ""); err != nil {
+						fmt.Fprintf(os.Stderr, "error: writing lyrics sidecar for %s: %s", targetPath, err)
+					}
+				}
+			}
 
 			item := WorkItem{
-				Task: fmt.Sprintf("%s to %s", inputRenderedPath, targetPath),
-				Args: args,
+				Task:          fmt.Sprintf("%s to %s", trackInputPath, targetPath),
+				InputPath:     trackInputPath,
+				TargetPath:    targetPath,
+				Extension:     extension,
+				Tags:          expectedTags,
+				Covers:        covers,
+				LyricsPath:    lyricsPath,
+				Args:          previewArgs,
+				Encoder:       encoder,
+				ManifestKey:   targetPath,
+				ManifestEntry: desiredEntry,
 			}
 
 			workItems = append(workItems, item)
 		}
 	}
 
-	return workItems
+	return workItems, pending
+}
+
+// writeWavSidecar copies sourcePath (a cover image or lyrics file) to a file named after
+// targetPath but with suffix and sourcePath's extension, e.g. "01 Track [id].wav" +
+// "cover.png" + "" becomes "01 Track [id].png", and a suffix of ".back" becomes
+// "01 Track [id].back.png" next to it.
+func writeWavSidecar(targetPath string, sourcePath string, suffix string) error {
+	sidecarPath := strings.TrimSuffix(targetPath, filepath.Ext(targetPath)) + suffix + filepath.Ext(sourcePath)
+
+	data, err := os.ReadFile(sourcePath)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(sidecarPath, data, 0666)
+}
+
+// maxCoverDimension is the largest width or height go-meta will embed without warning; several
+// players reject artwork larger than this.
+const maxCoverDimension = 3000
+
+// warnIfCoverTooLarge logs (but does not block on) an oversized cover, the same way unlock-music's
+// sniff package is used to validate artwork before embedding it.
+func warnIfCoverTooLarge(cover CoverSpec) {
+	width, height, err := sniffImageDimensions(cover.Path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "warning: could not read dimensions of %s: %s\n", cover.Path, err)
+		return
+	}
+	if width > maxCoverDimension || height > maxCoverDimension {
+		fmt.Fprintf(os.Stderr, "warning: %s is %dx%d, larger than %dx%d; some players may reject it\n",
+			cover.Path, width, height, maxCoverDimension, maxCoverDimension)
+	}
+}
+
+// sniffImageDimensions reads just enough of a PNG or JPEG file's header to report its pixel
+// dimensions, without decoding the whole image.
+func sniffImageDimensions(path string) (width int, height int, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer file.Close()
+
+	header := make([]byte, 32)
+	n, err := io.ReadFull(file, header)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return 0, 0, err
+	}
+	header = header[:n]
+
+	pngSignature := []byte{0x89, 'P', 'N', 'G', 0x0D, 0x0A, 0x1A, 0x0A}
+	if len(header) >= 24 && bytes.Equal(header[:8], pngSignature) {
+		// IHDR is always the first chunk: 4-byte length, "IHDR", then 4-byte width, 4-byte height.
+		width = int(binary.BigEndian.Uint32(header[16:20]))
+		height = int(binary.BigEndian.Uint32(header[20:24]))
+		return width, height, nil
+	}
+
+	if len(header) >= 4 && header[0] == 0xFF && header[1] == 0xD8 {
+		return sniffJPEGDimensions(io.MultiReader(bytes.NewReader(header[2:]), file))
+	}
+
+	return 0, 0, fmt.Errorf("unrecognized image header (not PNG or JPEG)")
+}
+
+// sniffJPEGDimensions scans JPEG markers looking for a start-of-frame (SOFn) segment, which
+// carries the image's height and width, skipping over every other segment by its declared length.
+func sniffJPEGDimensions(r io.Reader) (int, int, error) {
+	br := bufio.NewReader(r)
+
+	for {
+		marker, err := br.ReadByte()
+		if err != nil {
+			return 0, 0, fmt.Errorf("reading JPEG markers: %w", err)
+		}
+		if marker != 0xFF {
+			continue
+		}
+
+		segmentType, err := br.ReadByte()
+		if err != nil {
+			return 0, 0, fmt.Errorf("reading JPEG markers: %w", err)
+		}
+
+		switch {
+		case segmentType == 0x01 || (segmentType >= 0xD0 && segmentType <= 0xD9):
+			continue // markers with no payload (restart markers, SOI/EOI)
+		case segmentType >= 0xC0 && segmentType <= 0xCF && segmentType != 0xC4 && segmentType != 0xC8 && segmentType != 0xCC:
+			var length uint16
+			if err := binary.Read(br, binary.BigEndian, &length); err != nil {
+				return 0, 0, err
+			}
+			payload := make([]byte, length-2)
+			if _, err := io.ReadFull(br, payload); err != nil {
+				return 0, 0, err
+			}
+			// payload: 1-byte precision, 2-byte height, 2-byte width, ...
+			height := int(binary.BigEndian.Uint16(payload[1:3]))
+			width := int(binary.BigEndian.Uint16(payload[3:5]))
+			return width, height, nil
+		default:
+			var length uint16
+			if err := binary.Read(br, binary.BigEndian, &length); err != nil {
+				return 0, 0, err
+			}
+			if length < 2 {
+				return 0, 0, fmt.Errorf("malformed JPEG segment")
+			}
+			if _, err := io.CopyN(io.Discard, br, int64(length-2)); err != nil {
+				return 0, 0, err
+			}
+		}
+	}
 }
 
 // Overrides a string [basic] with another one [override] if available.
@@ -275,6 +1682,37 @@ func override(basic string, override *string) string {
 	}
 }
 
+// orderedTagKeys is the order go-meta writes -metadata arguments in. Kept separate from the map
+// returned by trackTagMap because map iteration order isn't deterministic.
+var orderedTagKeys = []string{"track", "title", "album", "genre", "date", "artist", "album_artist", "composer", "comment"}
+
+// trackTagMap computes the effective metadata tags (album metadata overridden per-track where
+// present) for a single track, keyed the same way ffmpeg's "-metadata" flag expects.
+func trackTagMap(trackNumber int, track Track, album Album) map[string]string {
+	artist := override(album.Artist, track.Artist)
+	return map[string]string{
+		"track":        fmt.Sprintf("%d", trackNumber),
+		"title":        track.Title,
+		"album":        album.Title,
+		"genre":        override(album.Genre, track.Genre),
+		"date":         override(album.Date, track.Date),
+		"artist":       artist,
+		"album_artist": artist,
+		"composer":     override(album.Composer, track.Composer),
+		"comment":      override(album.Copyright, track.Copyright),
+	}
+}
+
+// metadataArgs renders tags as a sequence of ffmpeg "-metadata key=value" arguments, in
+// orderedTagKeys order.
+func metadataArgs(tags map[string]string) []string {
+	args := make([]string, 0, len(orderedTagKeys)*2)
+	for _, key := range orderedTagKeys {
+		args = append(args, "-metadata", key+"="+tags[key])
+	}
+	return args
+}
+
 // Convert stdout and stderr messages from ffmpeg into something a bit tidier.
 func formatOutAndError(stdout, stderr string) string {
 	output := []string{}